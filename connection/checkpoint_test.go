@@ -0,0 +1,74 @@
+package connection
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/dqlite/go-sqlite3x"
+)
+
+func TestRegistry_Checkpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry-test-")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := NewRegistry(dir)
+	dsn := &DSN{Filename: "test.db"}
+	r.Add("test", dsn)
+
+	conn, err := r.open(dsn)
+	if err != nil {
+		t.Fatalf("failed to open connection: %v", err)
+	}
+	defer conn.Close()
+
+	// Checkpoint operates against whatever connection is registered as
+	// the follower for the database, regardless of how it got there.
+	r.followers["test"] = conn
+
+	if _, err := conn.Exec("CREATE TABLE t (n INTEGER)", nil); err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+	if _, err := conn.Exec("INSERT INTO t VALUES (1)", nil); err != nil {
+		t.Fatalf("failed to insert row: %v", err)
+	}
+
+	result, err := r.Checkpoint("test", CheckpointPassive)
+	if err != nil {
+		t.Fatalf("passive checkpoint failed: %v", err)
+	}
+	if result.Busy {
+		t.Error("expected an uncontended passive checkpoint not to be busy")
+	}
+	if result.CheckpointedFrames == 0 {
+		t.Error("expected the passive checkpoint to have moved WAL frames into the database file")
+	}
+
+	if _, err := conn.Exec("INSERT INTO t VALUES (2)", nil); err != nil {
+		t.Fatalf("failed to insert row: %v", err)
+	}
+
+	result, err = r.Checkpoint("test", CheckpointTruncate)
+	if err != nil {
+		t.Fatalf("truncate checkpoint failed: %v", err)
+	}
+	if result.Busy {
+		t.Error("expected an uncontended truncate checkpoint not to be busy")
+	}
+
+	info, err := os.Stat(sqlite3x.WalFilename(conn))
+	if err == nil && info.Size() != 0 {
+		t.Errorf("expected WAL file to be truncated, got size %d", info.Size())
+	}
+
+	stats := r.Stats()
+	if stats.Checkpoints != 2 {
+		t.Errorf("expected 2 recorded checkpoints, got %d", stats.Checkpoints)
+	}
+	if stats.CheckpointedPages == 0 {
+		t.Error("expected checkpointed pages to have been recorded")
+	}
+}
@@ -0,0 +1,90 @@
+package connection
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// DSN is a SQLite data source name, used to identify a database file
+// (or in-memory database) and any query string parameters that should
+// be passed to the SQLite driver when opening it.
+type DSN struct {
+	Filename string
+	Query    url.Values
+
+	// Memory indicates that this database has no on-disk backing and
+	// lives entirely in RAM, using SQLite's shared-cache in-memory
+	// mode. It's useful for tests and for small deployments that don't
+	// want to touch the filesystem.
+	Memory bool
+
+	// Pragmas holds extra pragmas (e.g. busy_timeout, foreign_keys,
+	// synchronous, cache_size, temp_store) to apply to every
+	// connection opened against this database. Pragmas given as
+	// "_pragma=key=value" entries in Query, matching the convention
+	// used by modernc.org/sqlite, are applied as well (taking
+	// precedence over an entry here with the same name); they are not
+	// copied into this field.
+	Pragmas map[string]string
+}
+
+// reservedPragmas can't be set through DSN.Pragmas, since the registry
+// depends on their mandatory values for replication to work correctly.
+var reservedPragmas = map[string]bool{
+	"journal_mode":       true,
+	"journal_size_limit": true,
+	"wal_autocheckpoint": true,
+}
+
+// pragmaNamePattern and pragmaValuePattern restrict pragma names and
+// values to the characters legitimate pragma settings (identifiers,
+// booleans, numbers, mode keywords) ever need, so they can be safely
+// interpolated into a "PRAGMA name=value" statement.
+var pragmaNamePattern = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+var pragmaValuePattern = regexp.MustCompile(`^[A-Za-z0-9_.+-]+$`)
+
+// pragmas returns the full set of pragmas to apply when opening a
+// connection against this DSN: those set explicitly on Pragmas, merged
+// with any parsed out of "_pragma" entries in Query.
+func (d *DSN) pragmas() (map[string]string, error) {
+	pragmas := map[string]string{}
+	for name, value := range d.Pragmas {
+		pragmas[strings.ToLower(strings.TrimSpace(name))] = value
+	}
+
+	for _, entry := range d.Query["_pragma"] {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid _pragma query string entry %q, expected key=value", entry)
+		}
+		name := strings.ToLower(strings.TrimSpace(parts[0]))
+		pragmas[name] = parts[1]
+	}
+
+	for name, value := range pragmas {
+		if !pragmaNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("invalid pragma name %q", name)
+		}
+		if reservedPragmas[name] {
+			return nil, fmt.Errorf("pragma %q can't be overridden, it's required for replication", name)
+		}
+		if !pragmaValuePattern.MatchString(value) {
+			return nil, fmt.Errorf("invalid value %q for pragma %q", value, name)
+		}
+	}
+
+	return pragmas, nil
+}
+
+// String renders the DSN as a "file:" URI suitable for passing to the
+// go-sqlite3 driver. The given dir is ignored for in-memory databases,
+// since they have no on-disk location.
+func (d *DSN) String(dir string) string {
+	if d.Memory {
+		return fmt.Sprintf("file:%s?mode=memory&cache=shared&%s", d.Filename, d.Query.Encode())
+	}
+	return fmt.Sprintf("file:%s?%s", filepath.Join(dir, d.Filename), d.Query.Encode())
+}
@@ -0,0 +1,44 @@
+package connection
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestDSN_PragmasRejectsReservedCaseInsensitive(t *testing.T) {
+	cases := []string{"journal_mode", "JOURNAL_MODE", " journal_mode", "Journal_Mode"}
+	for _, entry := range cases {
+		dsn := &DSN{
+			Query: url.Values{"_pragma": []string{entry + "=off"}},
+		}
+		if _, err := dsn.pragmas(); err == nil {
+			t.Errorf("expected pragma entry %q to be rejected as reserved", entry)
+		}
+	}
+}
+
+func TestDSN_PragmasRejectsInvalidValue(t *testing.T) {
+	dsn := &DSN{
+		Query: url.Values{"_pragma": []string{"busy_timeout=1000; DROP TABLE t"}},
+	}
+	if _, err := dsn.pragmas(); err == nil {
+		t.Error("expected pragma with an unsafe value to be rejected")
+	}
+}
+
+func TestDSN_PragmasMergesAndTrims(t *testing.T) {
+	dsn := &DSN{
+		Pragmas: map[string]string{" FOREIGN_KEYS ": "1"},
+		Query:   url.Values{"_pragma": []string{"busy_timeout=1000"}},
+	}
+	pragmas, err := dsn.pragmas()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if pragmas["foreign_keys"] != "1" {
+		t.Errorf("expected foreign_keys pragma to be trimmed and normalized to lowercase, got %v", pragmas)
+	}
+	if pragmas["busy_timeout"] != "1000" {
+		t.Errorf("expected busy_timeout pragma from query string, got %v", pragmas)
+	}
+}
@@ -0,0 +1,87 @@
+package connection
+
+import (
+	"expvar"
+	"sync/atomic"
+)
+
+// statKeys are the counters published under the process-wide
+// "cowsql.connection" expvar.Map.
+var statKeys = []string{
+	"open_leaders",
+	"open_followers",
+	"backups",
+	"backup_errors",
+	"backup_duration_ns",
+	"restores",
+	"checkpoints",
+	"checkpointed_pages",
+}
+
+// stats is the process-wide counters published by every Registry,
+// following the same approach as rqlite's db package so operators can
+// inspect connection activity (leaks, slow backups, ...) without
+// shelling into the node. It's an aggregate across every Registry in
+// the process, always published under the same well-known path so it
+// can be wired into a static scrape config; Registry.Stats() below
+// returns the per-instance breakdown.
+var stats = expvar.NewMap("cowsql.connection")
+
+// dbStats holds a per-database gauge of currently open connections
+// (leader and follower combined), keyed by database name.
+var dbStats = expvar.NewMap("cowsql.connection.databases")
+
+func init() {
+	for _, key := range statKeys {
+		stats.Add(key, 0)
+	}
+}
+
+// registryCounters holds the per-instance counters backing
+// Registry.Stats(), kept separate from the process-wide stats map
+// above so that multiple Registry instances (e.g. in tests) don't
+// stomp on each other's snapshots.
+type registryCounters struct {
+	openLeaders       int64
+	openFollowers     int64
+	backups           int64
+	backupErrors      int64
+	backupDurationNs  int64
+	restores          int64
+	checkpoints       int64
+	checkpointedPages int64
+}
+
+// addStat bumps both this registry's own counter and the process-wide
+// expvar counter published under key by delta.
+func (r *Registry) addStat(field *int64, key string, delta int64) {
+	atomic.AddInt64(field, delta)
+	stats.Add(key, delta)
+}
+
+// RegistryStats is a strongly-typed snapshot of a single Registry's own
+// counters, for callers that don't want to parse expvar.
+type RegistryStats struct {
+	OpenLeaders       int64
+	OpenFollowers     int64
+	Backups           int64
+	BackupErrors      int64
+	BackupDurationNs  int64
+	Restores          int64
+	Checkpoints       int64
+	CheckpointedPages int64
+}
+
+// Stats returns a snapshot of this registry's own counters.
+func (r *Registry) Stats() RegistryStats {
+	return RegistryStats{
+		OpenLeaders:       atomic.LoadInt64(&r.counters.openLeaders),
+		OpenFollowers:     atomic.LoadInt64(&r.counters.openFollowers),
+		Backups:           atomic.LoadInt64(&r.counters.backups),
+		BackupErrors:      atomic.LoadInt64(&r.counters.backupErrors),
+		BackupDurationNs:  atomic.LoadInt64(&r.counters.backupDurationNs),
+		Restores:          atomic.LoadInt64(&r.counters.restores),
+		Checkpoints:       atomic.LoadInt64(&r.counters.checkpoints),
+		CheckpointedPages: atomic.LoadInt64(&r.counters.checkpointedPages),
+	}
+}
@@ -0,0 +1,56 @@
+package connection
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestRegistry_StatsTracksOpenFollowers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry-test-")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := NewRegistry(dir)
+	r.Add("test", &DSN{Filename: "test.db"})
+
+	if stats := r.Stats(); stats.OpenFollowers != 0 {
+		t.Fatalf("expected no open followers yet, got %d", stats.OpenFollowers)
+	}
+
+	if err := r.OpenFollower("test"); err != nil {
+		t.Fatalf("failed to open follower: %v", err)
+	}
+	if stats := r.Stats(); stats.OpenFollowers != 1 {
+		t.Errorf("expected 1 open follower, got %d", stats.OpenFollowers)
+	}
+
+	if err := r.CloseFollower("test"); err != nil {
+		t.Fatalf("failed to close follower: %v", err)
+	}
+	if stats := r.Stats(); stats.OpenFollowers != 0 {
+		t.Errorf("expected 0 open followers after close, got %d", stats.OpenFollowers)
+	}
+}
+
+func TestRegistry_StatsIsolatedPerInstance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry-test-")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	r1 := NewRegistry(dir)
+	r1.Add("test", &DSN{Filename: "test.db"})
+	if err := r1.OpenFollower("test"); err != nil {
+		t.Fatalf("failed to open follower: %v", err)
+	}
+	defer r1.CloseFollower("test")
+
+	r2 := NewRegistry(dir)
+	if stats := r2.Stats(); stats.OpenFollowers != 0 {
+		t.Errorf("expected a fresh registry to have its own counters, got %d open followers", stats.OpenFollowers)
+	}
+}
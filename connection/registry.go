@@ -1,28 +1,47 @@
 package connection
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/dqlite/go-sqlite3x"
 	"github.com/mattn/go-sqlite3"
 	"github.com/pkg/errors"
 )
 
+const (
+	// defaultBackupPagesPerStep is the number of pages copied at each
+	// backup.Step() iteration, matching rqlite's default step size.
+	defaultBackupPagesPerStep = 128
+
+	// defaultBackupStepDelay is how long to sleep between backup steps.
+	defaultBackupStepDelay = 250 * time.Millisecond
+
+	// streamBufferSize bounds the buffer used to stream backup/restore
+	// content, so multi-GB databases don't need to fit in memory.
+	streamBufferSize = 256 * 1024
+)
+
 // Registry is a DQLite node-level data structure that tracks all
 // SQLite connections opened on the node, either in leader replication
 // mode or follower replication mode.
 type Registry struct {
 	mu             sync.RWMutex                   // Serialize access to internal state
 	dir            string                         // Directory where we store database files
+	memory         bool                           // Whether databases added to this registry have no on-disk backing
 	names          map[string]*DSN                // Map database identifiers to their DSN
 	leaders        map[*sqlite3.SQLiteConn]string // Leader connections to database names
 	followers      map[string]*sqlite3.SQLiteConn // Database names to follower connections
 	autoCheckpoint int                            // Number for WAL frames after which a checkpoint will be triggered
+	counters       registryCounters               // This registry's own counters, see metrics.go
 }
 
 // NewRegistry creates a new connections registry, managing
@@ -37,6 +56,16 @@ func NewRegistry(dir string) *Registry {
 	}
 }
 
+// NewMemoryRegistry creates a new connections registry whose databases
+// have no on-disk backing, living entirely in RAM. This is handy for
+// tests and for small deployments that want to run DQLite without
+// touching the filesystem.
+func NewMemoryRegistry() *Registry {
+	r := NewRegistry("")
+	r.memory = true
+	return r
+}
+
 // Dir is the directory where databases are kept.
 func (r *Registry) Dir() string {
 	r.mu.RLock()
@@ -65,6 +94,10 @@ func (r *Registry) Add(name string, dsn *DSN) {
 		panic(fmt.Sprintf("name '%s' is already registered", name))
 	}
 
+	if r.memory {
+		dsn.Memory = true
+	}
+
 	r.names[name] = dsn
 }
 
@@ -130,6 +163,9 @@ func (r *Registry) OpenFollower(name string) error {
 
 	r.followers[name] = conn
 
+	r.addStat(&r.counters.openFollowers, "open_followers", 1)
+	dbStats.Add(name, 1)
+
 	return nil
 
 }
@@ -141,6 +177,10 @@ func (r *Registry) CloseFollower(name string) error {
 
 	conn := r.follower(name)
 	delete(r.followers, name)
+
+	r.addStat(&r.counters.openFollowers, "open_followers", -1)
+	dbStats.Add(name, -1)
+
 	return conn.Close()
 }
 
@@ -179,6 +219,9 @@ func (r *Registry) OpenLeader(name string, methods sqlite3x.ReplicationMethods)
 
 	r.leaders[conn] = name
 
+	r.addStat(&r.counters.openLeaders, "open_leaders", 1)
+	dbStats.Add(name, 1)
+
 	return conn, nil
 
 }
@@ -199,12 +242,17 @@ func (r *Registry) CloseLeader(conn *sqlite3.SQLiteConn) error {
 		return err
 	}
 
+	name := r.leaders[conn]
+
 	if err := conn.Close(); err != nil {
 		return err
 	}
 
 	delete(r.leaders, conn)
 
+	r.addStat(&r.counters.openLeaders, "open_leaders", -1)
+	dbStats.Add(name, -1)
+
 	return nil
 }
 
@@ -223,21 +271,181 @@ func (r *Registry) Leaders(name string) []*sqlite3.SQLiteConn {
 	return conns
 }
 
+// CheckpointMode identifies one of the checkpoint algorithms offered
+// by SQLite's "PRAGMA wal_checkpoint" command.
+type CheckpointMode string
+
+// Checkpoint modes supported by Registry.Checkpoint. See
+// https://www.sqlite.org/pragma.html#pragma_wal_checkpoint.
+const (
+	CheckpointPassive  CheckpointMode = "PASSIVE"
+	CheckpointFull     CheckpointMode = "FULL"
+	CheckpointRestart  CheckpointMode = "RESTART"
+	CheckpointTruncate CheckpointMode = "TRUNCATE"
+)
+
+// CheckpointResult reports the outcome of a Registry.Checkpoint call.
+type CheckpointResult struct {
+	// Busy is true if the checkpoint could not run to completion
+	// because another connection was writing to, or checkpointing,
+	// the database.
+	Busy bool
+
+	// LogFrames is the number of frames in the WAL file.
+	LogFrames int
+
+	// CheckpointedFrames is the number of frames in the WAL that have
+	// been successfully moved back into the database file.
+	CheckpointedFrames int
+}
+
+// Checkpoint forces a WAL checkpoint of the given mode against the
+// database with the given name. It runs against the follower
+// connection rather than a leader one, to avoid contending with
+// whatever write lock a leader connection might be holding.
+func (r *Registry) Checkpoint(name string, mode CheckpointMode) (CheckpointResult, error) {
+	conn := r.Follower(name)
+
+	busy, log, checkpointed, err := sqlite3x.WalCheckpointPragma(conn, string(mode))
+	if err != nil {
+		return CheckpointResult{}, errors.Wrap(err, "failed to checkpoint database")
+	}
+
+	result := CheckpointResult{
+		Busy:               busy,
+		LogFrames:          log,
+		CheckpointedFrames: checkpointed,
+	}
+
+	if mode == CheckpointTruncate && !busy {
+		info, err := os.Stat(sqlite3x.WalFilename(conn))
+		if err == nil && info.Size() != 0 {
+			return result, fmt.Errorf("wal file was not truncated")
+		}
+	}
+
+	r.addStat(&r.counters.checkpoints, "checkpoints", 1)
+	r.addStat(&r.counters.checkpointedPages, "checkpointed_pages", int64(result.CheckpointedFrames))
+
+	return result, nil
+}
+
+// BackupOptions tunes the pacing and progress reporting of
+// Registry.BackupWithOptions.
+type BackupOptions struct {
+	// PagesPerStep is how many pages to copy at each backup iteration,
+	// instead of copying the whole database in one locked pass.
+	// Defaults to 128 if zero or negative.
+	PagesPerStep int
+
+	// StepDelay is how long to sleep between iterations, giving
+	// writers a chance to make progress. Defaults to 250ms if zero or
+	// negative.
+	StepDelay time.Duration
+
+	// Progress, if set, is invoked after every iteration with the
+	// number of pages still to copy and the total page count.
+	Progress func(remaining, pagecount int)
+
+	// Context, if set, allows cancelling an in-progress backup.
+	Context context.Context
+}
+
 // Backup a single database using the given leader connection. It
 // returns two slices of data, one the content of the backup database
 // and one is the current content of the WAL file.
 func (r *Registry) Backup(name string) ([]byte, []byte, error) {
+	return r.BackupWithOptions(name, BackupOptions{})
+}
+
+// BackupWithOptions behaves like Backup, which steps through the backup
+// in small page batches rather than copying the whole database in a
+// single locked pass, so that writers aren't starved on large
+// databases. It also lets the caller tune the batch size and the delay
+// between batches, report progress and cancel through the given
+// context.
+func (r *Registry) BackupWithOptions(name string, opts BackupOptions) ([]byte, []byte, error) {
+	start := time.Now()
+
+	database, wal, err := r.backupWithOptions(name, opts)
+
+	r.addStat(&r.counters.backupDurationNs, "backup_duration_ns", time.Since(start).Nanoseconds())
+	if err != nil {
+		r.addStat(&r.counters.backupErrors, "backup_errors", 1)
+		return nil, nil, err
+	}
+	r.addStat(&r.counters.backups, "backups", 1)
+
+	return database, wal, nil
+}
+
+func (r *Registry) backupWithOptions(name string, opts BackupOptions) ([]byte, []byte, error) {
+	if r.DSN(name).Memory {
+		// backupMemory serializes the whole database in one shot, so
+		// there's no step to pace, report progress on or cancel.
+		if opts.PagesPerStep != 0 || opts.StepDelay != 0 || opts.Progress != nil || opts.Context != nil {
+			return nil, nil, fmt.Errorf("backup options are not supported for in-memory database '%s'", name)
+		}
+		return r.backupMemory(name)
+	}
+
+	var database, wal bytes.Buffer
+	if err := r.backupTo(name, &database, &wal, opts); err != nil {
+		return nil, nil, err
+	}
+
+	return database.Bytes(), wal.Bytes(), nil
+}
+
+// BackupTo behaves like Backup, but streams the resulting database and
+// WAL content straight to the given writers instead of buffering them
+// in memory, which matters for multi-GB databases. Unlike Backup, it
+// returns an error for in-memory databases.
+func (r *Registry) BackupTo(name string, db io.Writer, wal io.Writer) error {
+	start := time.Now()
+
+	err := r.backupTo(name, db, wal, BackupOptions{})
+
+	r.addStat(&r.counters.backupDurationNs, "backup_duration_ns", time.Since(start).Nanoseconds())
+	if err != nil {
+		r.addStat(&r.counters.backupErrors, "backup_errors", 1)
+		return err
+	}
+	r.addStat(&r.counters.backups, "backups", 1)
+
+	return nil
+}
+
+func (r *Registry) backupTo(name string, db io.Writer, wal io.Writer, opts BackupOptions) error {
 	//name := r.NameByLeader(conn)
 	sourceDSN := r.DSN(name)
+
+	if sourceDSN.Memory {
+		return fmt.Errorf("streaming backup is not supported for in-memory database '%s'", name)
+	}
+
+	pagesPerStep := opts.PagesPerStep
+	if pagesPerStep <= 0 {
+		pagesPerStep = defaultBackupPagesPerStep
+	}
+	stepDelay := opts.StepDelay
+	if stepDelay <= 0 {
+		stepDelay = defaultBackupStepDelay
+	}
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
 	sourceConn, err := r.open(sourceDSN)
 	if err != nil {
-		return nil, nil, err
+		return err
 	}
 	defer sourceConn.Close()
 
 	backupConn, err := r.openBackup(sourceDSN)
 	if err != nil {
-		return nil, nil, err
+		return err
 	}
 	for _, path := range []string{
 		sqlite3x.DatabaseFilename(backupConn),
@@ -250,44 +458,90 @@ func (r *Registry) Backup(name string) ([]byte, []byte, error) {
 
 	backup, err := backupConn.Backup("main", sourceConn, "main")
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "failed to init backup database")
+		return errors.Wrap(err, "failed to init backup database")
 	}
 
-	done, err := backup.Step(-1)
-	backup.Close()
-	if err != nil {
-		return nil, nil, errors.Wrap(err, "failed to backup database")
-	}
-	if !done {
-		return nil, nil, fmt.Errorf("database backup not complete")
+	done := false
+	for !done {
+		select {
+		case <-ctx.Done():
+			backup.Finish()
+			return ctx.Err()
+		default:
+		}
+
+		done, err = backup.Step(pagesPerStep)
+		if err != nil {
+			backup.Finish()
+			return errors.Wrap(err, "failed to backup database")
+		}
+
+		if opts.Progress != nil {
+			opts.Progress(backup.Remaining(), backup.PageCount())
+		}
+
+		if !done {
+			time.Sleep(stepDelay)
+		}
 	}
+	backup.Close()
 
-	database, err := r.readDatabaseContent(sourceConn)
-	if err != nil {
-		return nil, nil, err
+	if err := streamFile(sqlite3x.DatabaseFilename(backupConn), db); err != nil {
+		return err
 	}
 
-	wal, err := r.readWalContent(backupConn)
-	if err != nil {
-		return nil, nil, err
+	if err := streamFile(sqlite3x.WalFilename(backupConn), wal); err != nil {
+		return err
 	}
 
-	return database, wal, nil
+	return nil
 }
 
 // Restore the given database and WAL backups.
 func (r *Registry) Restore(name string, database []byte, wal []byte) error {
-	if err := r.writeDatabaseContent(name, database); err != nil {
-		return err
+	return r.RestoreFrom(name, bytes.NewReader(database), bytes.NewReader(wal))
+}
+
+// RestoreFrom behaves like Restore, but reads the database and WAL
+// content directly from the given readers and writes them to disk
+// using an atomic rename, so that a crash mid-restore doesn't leave a
+// torn database behind. For in-memory databases the database content
+// is deserialized into the follower connection instead, and wal is not
+// read.
+func (r *Registry) RestoreFrom(name string, db io.Reader, wal io.Reader) error {
+	dsn := r.DSN(name)
+
+	if dsn.Memory {
+		database, err := ioutil.ReadAll(db)
+		if err != nil {
+			return errors.Wrap(err, "failed to read in-memory database content")
+		}
+		if err := r.restoreMemory(name, database); err != nil {
+			return err
+		}
+		r.addStat(&r.counters.restores, "restores", 1)
+		return nil
 	}
-	if err := r.writeWalContent(name, wal); err != nil {
-		return err
+
+	path := filepath.Join(r.Dir(), dsn.Filename)
+	if err := atomicWriteFrom(path, db); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("failed to restore database content at %s", path))
+	}
+
+	walPath := path + "-wal"
+	if err := atomicWriteFrom(walPath, wal); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("failed to restore wal content at %s", walPath))
 	}
+
+	r.addStat(&r.counters.restores, "restores", 1)
+
 	return nil
 }
 
 // Purge removes all database files in our directory, including the
-// directory itself.
+// directory itself, after closing all open connections. For
+// memory-only registries it only closes the connections, since they
+// have no on-disk state to remove.
 func (r *Registry) Purge() error {
 	for conn := range r.leaders {
 		r.CloseLeader(conn)
@@ -295,6 +549,9 @@ func (r *Registry) Purge() error {
 	for name := range r.followers {
 		r.CloseFollower(name)
 	}
+	if r.memory {
+		return nil
+	}
 	return os.RemoveAll(r.dir)
 }
 
@@ -312,18 +569,34 @@ func (r *Registry) open(dsn *DSN) (*sqlite3.SQLiteConn, error) {
 	// Convert driver.Conn interface to concrete sqlite3.SQLiteConn.
 	sqliteConn := conn.(*sqlite3.SQLiteConn)
 
-	// Ensure journal mode is set to WAL
-	if err := sqlite3x.JournalModePragma(sqliteConn, sqlite3x.JournalWal); err != nil {
+	pragmas, err := dsn.pragmas()
+	if err != nil {
 		return nil, err
 	}
 
-	// Ensure we don't truncate the WAL on exit.
-	if err := sqlite3x.JournalSizeLimitPragma(sqliteConn, -1); err != nil {
-		return nil, err
+	// In-memory databases don't have a WAL file to journal to, so the
+	// mandatory pragmas below don't apply to them.
+	if !dsn.Memory {
+		// Ensure journal mode is set to WAL
+		if err := sqlite3x.JournalModePragma(sqliteConn, sqlite3x.JournalWal); err != nil {
+			return nil, err
+		}
+
+		// Ensure we don't truncate the WAL on exit.
+		if err := sqlite3x.JournalSizeLimitPragma(sqliteConn, -1); err != nil {
+			return nil, err
+		}
+
+		if err := sqlite3x.DatabaseNoCheckpointOnClose(sqliteConn); err != nil {
+			return nil, err
+		}
 	}
 
-	if err := sqlite3x.DatabaseNoCheckpointOnClose(sqliteConn); err != nil {
-		return nil, err
+	for name, value := range pragmas {
+		stmt := fmt.Sprintf("PRAGMA %s=%s", name, value)
+		if _, err := sqliteConn.Exec(stmt, nil); err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("failed to set pragma %s", name))
+		}
 	}
 
 	return sqliteConn, nil
@@ -342,6 +615,7 @@ func (r *Registry) openBackup(dsn *DSN) (*sqlite3.SQLiteConn, error) {
 	backupDSN := &DSN{
 		Filename: path.Base(tempFile.Name()),
 		Query:    dsn.Query,
+		Pragmas:  dsn.Pragmas,
 	}
 	backupConn, err := r.open(backupDSN)
 	if err != nil {
@@ -351,45 +625,85 @@ func (r *Registry) openBackup(dsn *DSN) (*sqlite3.SQLiteConn, error) {
 	return backupConn, nil
 }
 
-// Read the current content of the database file associated with the given
-// connection.
-func (r *Registry) readDatabaseContent(conn *sqlite3.SQLiteConn) ([]byte, error) {
-	path := sqlite3x.DatabaseFilename(conn)
-	data, err := ioutil.ReadFile(path)
+// Backup an in-memory database by serializing the follower connection
+// that backs it, since there is no database file to copy.
+func (r *Registry) backupMemory(name string) ([]byte, []byte, error) {
+	conn := r.Follower(name)
+
+	database, err := sqlite3x.Serialize(conn)
 	if err != nil {
-		return nil, errors.Wrap(err, fmt.Sprintf("failed to read database content at %s", path))
+		return nil, nil, errors.Wrap(err, "failed to serialize in-memory database")
 	}
-	return data, nil
+
+	// A serialized in-memory database already contains everything that
+	// would otherwise live in the WAL, so there's no separate WAL backup.
+	return database, nil, nil
 }
 
-// Read the current content of the WAL associated with the given
-// connection.
-func (r *Registry) readWalContent(conn *sqlite3.SQLiteConn) ([]byte, error) {
-	path := sqlite3x.WalFilename(conn)
-	data, err := ioutil.ReadFile(path)
-	if err != nil {
-		return nil, errors.Wrap(err, fmt.Sprintf("failed to read WAL content at %s", path))
+// Restore an in-memory database by deserializing the given content
+// into the existing follower connection, so the shared-cache database
+// it's holding open gets replaced in place.
+func (r *Registry) restoreMemory(name string, database []byte) error {
+	conn := r.Follower(name)
+
+	if err := sqlite3x.Deserialize(conn, database); err != nil {
+		return errors.Wrap(err, "failed to deserialize in-memory database")
 	}
-	return data, nil
+
+	return nil
 }
 
-// Write the the content of a database backup to the DSN filename associated
-// with the given identifier.
-func (r *Registry) writeDatabaseContent(name string, database []byte) error {
-	path := filepath.Join(r.Dir(), r.DSN(name).Filename)
-	if err := ioutil.WriteFile(path, database, 0600); err != nil {
-		return errors.Wrap(err, fmt.Sprintf("failed to write database content at %s", path))
+// streamFile copies the content of the file at path to w, using a
+// bounded buffer so that large files don't need to be read into memory
+// all at once.
+func streamFile(path string, w io.Writer) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("failed to open %s", path))
+	}
+	defer f.Close()
+
+	buf := make([]byte, streamBufferSize)
+	if _, err := io.CopyBuffer(w, f, buf); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("failed to stream %s", path))
 	}
 	return nil
 }
 
-// Write the the content of a WAL backup to the DSN filename associated
-// with the given identifier.
-func (r *Registry) writeWalContent(name string, wal []byte) error {
-	path := filepath.Join(r.Dir(), r.DSN(name).Filename+"-wal")
-	if err := ioutil.WriteFile(path, wal, 0600); err != nil {
-		return errors.Wrap(err, fmt.Sprintf("failed to write wal content at %s", path))
+// atomicWriteFrom writes the content of r to path, by first writing it
+// to a temporary file in the same directory, fsync-ing it and renaming
+// it into place, so a crash won't leave a torn file at path.
+func atomicWriteFrom(path string, r io.Reader) error {
+	tempPath := path + ".tmp"
+
+	f, err := os.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("failed to create %s", tempPath))
+	}
+
+	buf := make([]byte, streamBufferSize)
+	if _, err := io.CopyBuffer(f, r, buf); err != nil {
+		f.Close()
+		os.Remove(tempPath)
+		return errors.Wrap(err, fmt.Sprintf("failed to write %s", tempPath))
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tempPath)
+		return errors.Wrap(err, fmt.Sprintf("failed to fsync %s", tempPath))
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(tempPath)
+		return errors.Wrap(err, fmt.Sprintf("failed to close %s", tempPath))
+	}
+
+	if err := os.Rename(tempPath, path); err != nil {
+		os.Remove(tempPath)
+		return errors.Wrap(err, fmt.Sprintf("failed to rename %s to %s", tempPath, path))
 	}
+
 	return nil
 }
 
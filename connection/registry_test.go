@@ -0,0 +1,148 @@
+package connection
+
+import (
+	"bytes"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/dqlite/go-sqlite3x"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestNewMemoryRegistry(t *testing.T) {
+	r := NewMemoryRegistry()
+
+	dsn := &DSN{Filename: "test.db"}
+	r.Add("test", dsn)
+
+	if !r.DSN("test").Memory {
+		t.Error("expected DSN added to a memory registry to be marked as in-memory")
+	}
+
+	conn, err := r.open(dsn)
+	if err != nil {
+		t.Fatalf("failed to open in-memory connection: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Exec("CREATE TABLE test (n INTEGER)", nil); err != nil {
+		t.Fatalf("failed to write to in-memory database: %v", err)
+	}
+}
+
+func TestNewMemoryRegistry_BackupToUnsupported(t *testing.T) {
+	r := NewMemoryRegistry()
+	r.Add("test", &DSN{Filename: "test.db"})
+
+	var db, wal bytes.Buffer
+	if err := r.BackupTo("test", &db, &wal); err == nil {
+		t.Error("expected streaming backup of an in-memory database to fail")
+	}
+}
+
+func TestNewMemoryRegistry_BackupWithOptionsUnsupported(t *testing.T) {
+	r := NewMemoryRegistry()
+	r.Add("test", &DSN{Filename: "test.db"})
+
+	conn, err := r.open(r.DSN("test"))
+	if err != nil {
+		t.Fatalf("failed to open in-memory connection: %v", err)
+	}
+	defer conn.Close()
+	r.followers["test"] = conn
+
+	// Backup() itself must keep working for in-memory databases...
+	if _, _, err := r.Backup("test"); err != nil {
+		t.Errorf("expected plain Backup of an in-memory database to succeed, got %v", err)
+	}
+
+	// ...but pacing/progress/cancellation options must be rejected
+	// rather than silently ignored, matching BackupTo's behavior.
+	opts := BackupOptions{PagesPerStep: 16}
+	if _, _, err := r.BackupWithOptions("test", opts); err == nil {
+		t.Error("expected BackupWithOptions with options set to fail for an in-memory database")
+	}
+}
+
+// TestRegistry_BackupToSnapshot exercises a write that lands on the
+// source connection's main database file after the backup connection
+// has already copied every page. BackupTo must ship the snapshot taken
+// by the backup connection, not whatever happens to be on disk for the
+// source connection by the time it streams the result.
+func TestRegistry_BackupToSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry-test-")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := NewRegistry(dir)
+	dsn := &DSN{Filename: "test.db"}
+	r.Add("test", dsn)
+
+	conn, err := r.open(dsn)
+	if err != nil {
+		t.Fatalf("failed to open source connection: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Exec("CREATE TABLE t (n INTEGER)", nil); err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+	if _, err := conn.Exec("INSERT INTO t VALUES (1)", nil); err != nil {
+		t.Fatalf("failed to insert row: %v", err)
+	}
+
+	opts := BackupOptions{
+		Progress: func(remaining, pagecount int) {
+			if remaining != 0 {
+				return
+			}
+			if _, err := conn.Exec("INSERT INTO t VALUES (2)", nil); err != nil {
+				t.Fatalf("failed to insert row after backup step: %v", err)
+			}
+			if _, _, _, err := sqlite3x.WalCheckpointPragma(conn, "TRUNCATE"); err != nil {
+				t.Fatalf("failed to checkpoint source after backup step: %v", err)
+			}
+		},
+	}
+
+	var db, wal bytes.Buffer
+	if err := r.backupTo("test", &db, &wal, opts); err != nil {
+		t.Fatalf("backupTo failed: %v", err)
+	}
+
+	backupFile, err := ioutil.TempFile("", "backup-*.db")
+	if err != nil {
+		t.Fatalf("failed to create temp backup file: %v", err)
+	}
+	defer os.Remove(backupFile.Name())
+	if _, err := backupFile.Write(db.Bytes()); err != nil {
+		t.Fatalf("failed to write backup content: %v", err)
+	}
+	backupFile.Close()
+
+	// The backup connection is in WAL mode, so the copied pages live in
+	// its WAL: restore both files side by side before reading.
+	walPath := backupFile.Name() + "-wal"
+	defer os.Remove(walPath)
+	if err := ioutil.WriteFile(walPath, wal.Bytes(), 0600); err != nil {
+		t.Fatalf("failed to write backup wal content: %v", err)
+	}
+
+	backupDB, err := sql.Open("sqlite3", backupFile.Name())
+	if err != nil {
+		t.Fatalf("failed to open backup file: %v", err)
+	}
+	defer backupDB.Close()
+
+	var count int
+	if err := backupDB.QueryRow("SELECT count(*) FROM t").Scan(&count); err != nil {
+		t.Fatalf("failed to query backup content: %v", err)
+	}
+	if count != 1 {
+		t.Errorf("expected backup to contain the snapshot taken mid-step (1 row), got %d", count)
+	}
+}